@@ -1,19 +1,38 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/fields"
 	kubecmd "k8s.io/kubernetes/pkg/kubectl/cmd"
 	kcmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"k8s.io/kubernetes/pkg/kubectl/resource"
+	"k8s.io/kubernetes/pkg/labels"
 	"k8s.io/kubernetes/pkg/util/term"
 
 	"github.com/openshift/origin/pkg/cmd/util/clientcmd"
 )
 
+// defaultContainerAnnotation mirrors kubectl's convention for declaring which
+// container of a multi-container pod should be treated as the default target.
+const defaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// defaultShells is the ordered list of shells rsh tries when none of them is
+// requested explicitly. It favors bash but falls back to shells commonly
+// available on minimal/distroless-ish images.
+const defaultShells = "/bin/bash,/bin/sh,/bin/ash"
+
 const (
 	RshRecommendedName = "rsh"
 
@@ -23,10 +42,20 @@ Open a remote shell session to a container
 This command will attempt to start a shell session in a pod for the specified resource.
 It works with pods, deployment configs, jobs, daemon sets, and replication controllers.
 Any of the aforementioned resources (apart from pods) will be resolved to a ready pod.
-It will default to the first container if none is specified, and will attempt to use
-'/bin/bash' as the default shell. You may pass an optional command after the resource name,
-which will be executed instead of a login shell. A TTY will be automatically allocated
-if standard input is interactive - use -t and -T to override.
+Instead of a resource name, a file or label selector may be given with --filename or
+--selector to pick the target pod, mirroring how kubectl exec resolves its target.
+Combining --selector with --all-pods and a non-interactive command fans the command
+out to every matching pod concurrently (throttled by --max-parallel), prefixing each
+line of output with [pod/container] and exiting with the highest exit code seen.
+The session can be captured for audit and replay with --record-to, in raw,
+asciicast, or classic script(1) 'typescript' format (--record-format).
+If no container is specified, it will default to the container named by the pod's
+'kubectl.kubernetes.io/default-container' annotation, falling back to the first
+container, and will attempt to use the first available shell out of '/bin/bash',
+'/bin/sh' and '/bin/ash' (override with --shell) as the login shell. You may pass
+an optional command after the resource name, which will be executed instead of a
+login shell. A TTY will be automatically allocated if standard input is
+interactive - use -t and -T to override.
 
 Note, some containers may not include a shell - use '%[1]s exec' if you need to run commands
 directly.`
@@ -42,22 +71,79 @@ directly.`
   %[1]s dc/docker-registry cat config.yml
 
   # Open a shell session on the container named 'index' inside a pod of your job
-  # %[1]s -c index job/sheduled`
+  # %[1]s -c index job/sheduled
+
+  # Open a shell session on the pod defined in pod.yaml
+  %[1]s -f pod.yaml
+
+  # Open a shell session on a pod selected by label
+  %[1]s -l app=web
+
+  # Run 'date' on every pod selected by label, five at a time
+  %[1]s -l app=web --all-pods --max-parallel 5 date
+
+  # Record the shell session to an asciicast file for later replay
+  %[1]s --record-to session.cast foo`
 )
 
 // RshOptions declare the arguments accepted by the Rsh command
 type RshOptions struct {
 	ForceTTY   bool
 	DisableTTY bool
-	Executable string
+
+	// Shell is a comma-separated, ordered list of shell paths to try on the
+	// remote container. The first candidate that exists and is executable is
+	// used as the login shell.
+	Shell string
+
+	// StreamTimeout bounds the total duration of the remote shell's
+	// stdout/stderr copy loop, as an absolute deadline on the whole session
+	// rather than an idle/no-output timeout; the streams are forcibly closed
+	// once it elapses, whether or not output was flowing. Zero disables the
+	// timeout.
+	StreamTimeout time.Duration
+
+	// Filename points at a file, directory or URL holding the resource to
+	// open a shell to, mirroring kubectl exec's --filename flag.
+	Filename string
+	// Selector is a label query used to pick the target pod when no
+	// resource name is given on the command line.
+	Selector string
+	// AnyPod, when set, resolves ambiguous --selector matches by picking the
+	// first matching pod instead of erroring out.
+	AnyPod bool
+
+	// AllPods fans a non-interactive command out to every pod matched by
+	// Selector concurrently, prefixing each line of output with
+	// [pod/container].
+	AllPods bool
+	// MaxParallel throttles how many pods are exec'd into at once when
+	// AllPods is set.
+	MaxParallel int
+
+	// RecordTo, when set, tees the session's input/output to this local
+	// file for audit and replay.
+	RecordTo string
+	// RecordFormat controls the encoding used when RecordTo is set: one of
+	// "raw", "asciicast" or "typescript".
+	RecordFormat string
+
 	*kubecmd.ExecOptions
 }
 
+// Supported values for RshOptions.RecordFormat.
+const (
+	RecordFormatRaw        = "raw"
+	RecordFormatAsciicast  = "asciicast"
+	RecordFormatTypescript = "typescript"
+)
+
 // NewCmdRsh returns a command that attempts to open a shell session to the server.
 func NewCmdRsh(name string, parent string, f *clientcmd.Factory, in io.Reader, out, err io.Writer) *cobra.Command {
 	options := &RshOptions{
-		ForceTTY:   false,
-		DisableTTY: false,
+		ForceTTY:     false,
+		DisableTTY:   false,
+		RecordFormat: RecordFormatAsciicast,
 		ExecOptions: &kubecmd.ExecOptions{
 			StreamOptions: kubecmd.StreamOptions{
 				In:  in,
@@ -73,7 +159,7 @@ func NewCmdRsh(name string, parent string, f *clientcmd.Factory, in io.Reader, o
 	}
 
 	cmd := &cobra.Command{
-		Use:     fmt.Sprintf("%s [options] POD [COMMAND]", name),
+		Use:     fmt.Sprintf("%s [options] (POD | -f FILENAME | -l SELECTOR) [COMMAND]", name),
 		Short:   "Start a shell session in a pod",
 		Long:    fmt.Sprintf(rshLong, parent),
 		Example: fmt.Sprintf(rshExample, parent+" "+name),
@@ -85,8 +171,16 @@ func NewCmdRsh(name string, parent string, f *clientcmd.Factory, in io.Reader, o
 	}
 	cmd.Flags().BoolVarP(&options.ForceTTY, "tty", "t", false, "Force a pseudo-terminal to be allocated")
 	cmd.Flags().BoolVarP(&options.DisableTTY, "no-tty", "T", false, "Disable pseudo-terminal allocation")
-	cmd.Flags().StringVar(&options.Executable, "shell", "/bin/sh", "Path to the shell command")
+	cmd.Flags().StringVar(&options.Shell, "shell", defaultShells, "Comma-separated list of shells to try, in order; the first one found on the container is used")
 	cmd.Flags().StringVarP(&options.ContainerName, "container", "c", "", "Container name; defaults to first container")
+	cmd.Flags().DurationVar(&options.StreamTimeout, "stream-timeout", 0, "Maximum total duration of the remote shell session before its streams are forcibly closed (0 to disable)")
+	cmd.Flags().StringVarP(&options.Filename, "filename", "f", "", "Filename, directory, or URL to a file identifying the resource to open a shell to")
+	cmd.Flags().StringVarP(&options.Selector, "selector", "l", "", "Selector (label query) to filter the pod to open a shell to, when no resource name is given")
+	cmd.Flags().BoolVar(&options.AnyPod, "any", false, "If the resource or selector matches multiple pods, open a shell to the first one instead of erroring out")
+	cmd.Flags().BoolVar(&options.AllPods, "all-pods", false, "Run a non-interactive command against every pod matched by --selector concurrently, prefixing output with [pod/container]")
+	cmd.Flags().IntVar(&options.MaxParallel, "max-parallel", 10, "Maximum number of pods to run the command against concurrently when --all-pods is set")
+	cmd.Flags().StringVar(&options.RecordTo, "record-to", "", "Record the session's input/output to the given local file")
+	cmd.Flags().StringVar(&options.RecordFormat, "record-format", RecordFormatAsciicast, "Format to record the session in when --record-to is set: raw, asciicast, or typescript")
 	cmd.Flags().SetInterspersed(false)
 	return cmd
 }
@@ -104,17 +198,71 @@ func (o *RshOptions) Complete(f *clientcmd.Factory, cmd *cobra.Command, args []s
 		o.TTY = term.IsTerminal(o.In)
 	}
 
-	if len(args) < 1 {
-		return kcmdutil.UsageError(cmd, "rsh requires a single Pod to connect to")
+	if o.AllPods {
+		if len(o.Selector) == 0 {
+			return kcmdutil.UsageError(cmd, "--all-pods requires --selector to pick the target pods")
+		}
+		if len(args) == 0 {
+			return kcmdutil.UsageError(cmd, "--all-pods requires a command to run against every matched pod")
+		}
+		if o.ForceTTY {
+			return kcmdutil.UsageError(cmd, "--all-pods cannot be combined with -t; it only runs non-interactive commands")
+		}
+		o.TTY = false
+		o.Command = args
+		return o.completeClient(f)
+	}
+
+	var resourceArg string
+	switch {
+	case len(o.Filename) > 0 || len(o.Selector) > 0:
+		// target is resolved via the builder/selector machinery below; any
+		// remaining args are the command to run.
+	case len(args) < 1:
+		return kcmdutil.UsageError(cmd, "rsh requires a single Pod to connect to, or --filename/--selector")
+	default:
+		resourceArg = args[0]
+		args = args[1:]
+	}
+
+	if err := o.completeClient(f); err != nil {
+		return err
+	}
+
+	var err error
+	switch {
+	case len(o.Filename) > 0 || len(o.Selector) > 0:
+		o.PodName, err = o.podForFilenameOrSelector(f)
+	default:
+		// TODO: Consider making the timeout configurable
+		o.PodName, err = f.PodForResource(resourceArg, 10*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(o.ContainerName) == 0 {
+		if err := o.completeDefaultContainer(); err != nil {
+			return err
+		}
 	}
-	resource := args[0]
-	args = args[1:]
+
 	if len(args) > 0 {
 		o.Command = args
-	} else {
-		o.Command = []string{o.Executable}
+		return nil
 	}
 
+	shell, err := o.detectShell()
+	if err != nil {
+		return err
+	}
+	o.Command = []string{shell}
+	return nil
+}
+
+// completeClient resolves the namespace, client config and client shared by
+// every RshOptions code path.
+func (o *RshOptions) completeClient(f *clientcmd.Factory) error {
 	namespace, _, err := f.DefaultNamespace()
 	if err != nil {
 		return err
@@ -132,18 +280,543 @@ func (o *RshOptions) Complete(f *clientcmd.Factory, cmd *cobra.Command, args []s
 		return err
 	}
 	o.Client = client
+	return nil
+}
+
+// podForFilenameOrSelector resolves the --filename and/or --selector flags to
+// a single pod using the same builder machinery kubectl exec relies on. It
+// errors out if the input matches more than one pod, unless --any is set, in
+// which case the first match is used.
+func (o *RshOptions) podForFilenameOrSelector(f *clientcmd.Factory) (string, error) {
+	var filenames []string
+	if len(o.Filename) > 0 {
+		filenames = []string{o.Filename}
+	}
+
+	mapper, typer := f.Object()
+	r := resource.NewBuilder(mapper, typer, f.ClientMapperForCommand(), kcmdutil.CodecFactory(f.JSONEncoder())).
+		NamespaceParam(o.Namespace).DefaultNamespace().
+		FilenameParam(false, &resource.FilenameOptions{Filenames: filenames}).
+		SelectorParam(o.Selector).
+		ResourceTypeOrNameArgs(false, "pods").
+		SingleResourceType().
+		Do()
+
+	infos, err := r.Infos()
+	if err != nil {
+		return "", err
+	}
+	if len(infos) == 0 {
+		return "", fmt.Errorf("no pods found matching the given --filename/--selector")
+	}
+	if len(infos) > 1 && !o.AnyPod {
+		names := make([]string, 0, len(infos))
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		return "", fmt.Errorf("multiple pods match (%s); pass --any to pick one, or narrow the selector", strings.Join(names, ", "))
+	}
+	return infos[0].Name, nil
+}
 
-	// TODO: Consider making the timeout configurable
-	o.PodName, err = f.PodForResource(resource, 10*time.Second)
-	return err
+// detectShell tries each of the shells configured in o.Shell, in order,
+// probing the remote container with a non-TTY `test -x <shell>` exec and
+// returning the first one that reports success. If none of the candidates
+// are usable it returns an error listing everything that was tried.
+func (o *RshOptions) detectShell() (string, error) {
+	tried := []string{}
+	for _, shell := range strings.Split(o.Shell, ",") {
+		shell = strings.TrimSpace(shell)
+		if len(shell) == 0 {
+			continue
+		}
+		tried = append(tried, shell)
+
+		probe := *o.ExecOptions
+		probe.TTY = false
+		probe.Stdin = false
+		probe.In = nil
+		probe.Out = ioutil.Discard
+		probe.Err = ioutil.Discard
+		probe.Command = []string{"test", "-x", shell}
+
+		if err := probe.Run(); err == nil {
+			return shell, nil
+		}
+	}
+	return "", fmt.Errorf("no usable shell found on the container, tried: %s", strings.Join(tried, ", "))
+}
+
+// completeDefaultContainer inspects the resolved pod and, when no container
+// was explicitly requested, prefers the container named by the
+// kubectl.kubernetes.io/default-container annotation over blindly defaulting
+// to the first container in the pod spec. If the annotation is absent and the
+// pod has more than one container, a warning listing the available
+// containers is printed before falling back to the first container.
+func (o *RshOptions) completeDefaultContainer() error {
+	pod, err := o.Client.Pods(o.Namespace).Get(o.PodName)
+	if err != nil {
+		return err
+	}
+
+	container, names := defaultContainerFor(pod)
+	o.ContainerName = container
+	if len(names) > 1 {
+		fmt.Fprintf(o.Err, "Defaulting container name to %s.\n", container)
+		fmt.Fprintf(o.Err, "Available containers: %s\n", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// defaultContainerFor picks the container to target on pod when none was
+// explicitly requested: the kubectl.kubernetes.io/default-container
+// annotation if present, otherwise the first container in the pod spec.
+// When the first container is picked, names lists every container in the pod
+// so callers can warn when the fallback was ambiguous (len(names) > 1); names
+// is nil when the annotation decided or the pod has no containers.
+func defaultContainerFor(pod *kapi.Pod) (container string, names []string) {
+	if name, ok := pod.Annotations[defaultContainerAnnotation]; ok && len(name) > 0 {
+		return name, nil
+	}
+
+	if len(pod.Spec.Containers) == 0 {
+		return "", nil
+	}
+
+	names = make([]string, 0, len(pod.Spec.Containers))
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return names[0], names
 }
 
 // Validate ensures that RshOptions are valid
 func (o *RshOptions) Validate() error {
+	if o.AllPods {
+		if len(o.Command) == 0 {
+			return fmt.Errorf("--all-pods requires a command to run")
+		}
+		if len(o.RecordTo) > 0 {
+			return fmt.Errorf("--record-to cannot be used with --all-pods: a recording captures a single TTY session, not the combined output of multiple pods")
+		}
+		return nil
+	}
+
+	if len(o.RecordTo) > 0 {
+		switch o.RecordFormat {
+		case RecordFormatRaw, RecordFormatAsciicast, RecordFormatTypescript:
+		default:
+			return fmt.Errorf("invalid --record-format %q: must be one of %s, %s, %s", o.RecordFormat, RecordFormatRaw, RecordFormatAsciicast, RecordFormatTypescript)
+		}
+	}
+
 	return o.ExecOptions.Validate()
 }
 
 // Run starts a remote shell session on the server
 func (o *RshOptions) Run() error {
-	return o.ExecOptions.Run()
+	if o.AllPods {
+		return o.runAllPods()
+	}
+
+	if len(o.RecordTo) > 0 {
+		rec, err := newSessionRecorder(o.RecordTo, o.RecordFormat)
+		if err != nil {
+			return err
+		}
+
+		stop := make(chan struct{})
+		resizeDone := make(chan struct{})
+		go func() {
+			defer close(resizeDone)
+			watchTerminalResize(rec, stop)
+		}()
+		// Signal the resize watcher and wait for it to actually exit before
+		// closing the recording - otherwise a SIGWINCH arriving right at
+		// session end could still be writing to rec.file after Close().
+		defer func() {
+			close(stop)
+			<-resizeDone
+			rec.Close()
+		}()
+
+		if o.In != nil {
+			o.In = &teeReader{in: o.In, rec: rec}
+		}
+		o.Out = &teeWriter{out: o.Out, rec: rec}
+		o.Err = &teeWriter{out: o.Err, rec: rec}
+	}
+
+	if o.StreamTimeout <= 0 {
+		return o.ExecOptions.Run()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- o.ExecOptions.Run()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(o.StreamTimeout):
+		o.closeStreams()
+		return fmt.Errorf("timeout exceeded: the remote shell session did not complete within %s", o.StreamTimeout)
+	}
+}
+
+// closeStreams closes the underlying IO streams so that an executor blocked
+// on a stuck container's output is unblocked once the stream timeout fires.
+func (o *RshOptions) closeStreams() {
+	for _, s := range []interface{}{o.In, o.Out, o.Err} {
+		if closer, ok := s.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// runAllPods fans the configured command out to every pod matched by
+// o.Selector, running up to o.MaxParallel execs concurrently and prefixing
+// each line of output with [pod/container]. The highest non-zero exit code
+// observed across all pods becomes the process's own exit code.
+func (o *RshOptions) runAllPods() error {
+	pods, err := o.podsForSelector()
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no pods matched selector %q", o.Selector)
+	}
+
+	maxParallel := o.MaxParallel
+	if maxParallel <= 0 {
+		maxParallel = 1
+	}
+	sem := make(chan struct{}, maxParallel)
+
+	// Both sinks are shared across every pod's goroutine so that lines from
+	// different pods can never interleave mid-write; each prefixWriter only
+	// buffers its own pod's partial lines before flushing a complete one
+	// through the shared, mutex-guarded sink.
+	outSink := newPrefixWriterSink(o.Out)
+	errSink := newPrefixWriterSink(o.Err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	highestExitCode := 0
+
+	for i := range pods {
+		pod := pods[i]
+		container := o.ContainerName
+		if len(container) == 0 {
+			var names []string
+			container, names = defaultContainerFor(&pod)
+			if len(names) > 1 {
+				errSink.writeLine(fmt.Sprintf("[%s]", pod.Name), []byte(fmt.Sprintf("Defaulting container name to %s.\n", container)))
+			}
+		}
+		prefix := fmt.Sprintf("[%s/%s]", pod.Name, container)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			single := *o.ExecOptions
+			single.PodName = pod.Name
+			single.ContainerName = container
+			single.TTY = false
+			single.Stdin = false
+			single.In = nil
+			out := newPrefixWriter(outSink, prefix)
+			errOut := newPrefixWriter(errSink, prefix)
+			single.Out = out
+			single.Err = errOut
+
+			exitCode := 0
+			if err := single.Run(); err != nil {
+				exitCode = exitCodeFromError(err)
+				errSink.writeLine(prefix, []byte(fmt.Sprintf("error: %v\n", err)))
+			}
+			// Flush whatever partial line is left unterminated in either
+			// buffer once the pod's exec has finished, so output that
+			// doesn't end in a newline isn't lost.
+			out.Close()
+			errOut.Close()
+
+			mu.Lock()
+			if exitCode > highestExitCode {
+				highestExitCode = exitCode
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if highestExitCode != 0 {
+		return &fanOutExitError{code: highestExitCode}
+	}
+	return nil
+}
+
+// fanOutExitError reports the highest exit code observed while running a
+// command across multiple pods with --all-pods. It implements the same
+// ExitStatus() contract as a single pod's remote exec error so that
+// kcmdutil.CheckErr exits the process with it, the same way it already does
+// for an ordinary single-pod rsh failure.
+type fanOutExitError struct {
+	code int
+}
+
+func (e *fanOutExitError) Error() string {
+	return fmt.Sprintf("command failed on one or more pods (highest exit code %d)", e.code)
+}
+
+func (e *fanOutExitError) ExitStatus() int {
+	return e.code
+}
+
+// podsForSelector lists every pod in the namespace matching o.Selector.
+func (o *RshOptions) podsForSelector() ([]kapi.Pod, error) {
+	selector, err := labels.Parse(o.Selector)
+	if err != nil {
+		return nil, err
+	}
+	list, err := o.Client.Pods(o.Namespace).List(selector, fields.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// exitStatuser is implemented by remote command errors that carry the
+// process's actual exit status.
+type exitStatuser interface {
+	ExitStatus() int
+}
+
+// exitCodeFromError extracts the remote process's exit code from an error
+// returned by ExecOptions.Run, defaulting to 1 for errors that don't carry
+// one (e.g. connection failures).
+func exitCodeFromError(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(exitStatuser); ok {
+		return exitErr.ExitStatus()
+	}
+	return 1
+}
+
+// prefixWriterSink serializes writes from every pod's prefixWriter onto a
+// single shared underlying writer, so concurrent --all-pods goroutines can
+// never interleave a write mid-line.
+type prefixWriterSink struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func newPrefixWriterSink(out io.Writer) *prefixWriterSink {
+	return &prefixWriterSink{out: out}
+}
+
+func (s *prefixWriterSink) writeLine(prefix string, line []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.out, "%s %s", prefix, line)
+}
+
+// prefixWriter buffers a single pod's output until a full line is available,
+// then flushes it, prefixed, through the shared sink. Each prefixWriter is
+// only ever written to by one goroutine, so the buffer itself needs no
+// locking - only the sink's Write to the shared destination does.
+type prefixWriter struct {
+	sink   *prefixWriterSink
+	prefix string
+	buf    bytes.Buffer
+}
+
+func newPrefixWriter(sink *prefixWriterSink, prefix string) *prefixWriter {
+	return &prefixWriter{sink: sink, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// incomplete line, put it back for the next Write
+			w.buf.WriteString(line)
+			break
+		}
+		w.sink.writeLine(w.prefix, []byte(line))
+	}
+	return len(p), nil
+}
+
+// Close flushes any bytes still buffered since the last newline through the
+// sink. Callers must invoke this once they're done writing, or a final line
+// of output that never ends in '\n' is silently lost.
+func (w *prefixWriter) Close() error {
+	if w.buf.Len() > 0 {
+		w.sink.writeLine(w.prefix, w.buf.Bytes())
+		w.buf.Reset()
+	}
+	return nil
+}
+
+// sessionRecorder tees a TTY session's input, output and resize events to a
+// local file, encoded in one of RecordFormatRaw, RecordFormatAsciicast or
+// RecordFormatTypescript.
+type sessionRecorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	format string
+	start  time.Time
+}
+
+func newSessionRecorder(path, format string) (*sessionRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create --record-to file: %v", err)
+	}
+
+	rec := &sessionRecorder{file: file, format: format, start: time.Now()}
+	if err := rec.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (r *sessionRecorder) writeHeader() error {
+	switch r.format {
+	case RecordFormatAsciicast:
+		header := map[string]interface{}{
+			"version": 2,
+			"width":   80,
+			"height":  24,
+			"env":     map[string]string{"TERM": os.Getenv("TERM")},
+		}
+		data, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(r.file, "%s\n", data)
+		return err
+	case RecordFormatTypescript:
+		_, err := fmt.Fprintf(r.file, "Script started on %s\n", r.start.Format(time.ANSIC))
+		return err
+	default:
+		return nil
+	}
+}
+
+// recordOutput appends an output chunk to the recording.
+func (r *sessionRecorder) recordOutput(p []byte) {
+	r.recordEvent("o", p)
+}
+
+// recordInput appends an input chunk to the recording. Only the asciicast
+// format distinguishes input from output; raw and typescript only capture
+// output, matching what a replay would show on the terminal.
+func (r *sessionRecorder) recordInput(p []byte) {
+	if r.format != RecordFormatAsciicast {
+		return
+	}
+	r.recordEvent("i", p)
+}
+
+// recordResize appends a terminal resize event to the recording. Only the
+// asciicast format supports resize events.
+func (r *sessionRecorder) recordResize(cols, rows int) {
+	if r.format != RecordFormatAsciicast {
+		return
+	}
+	r.recordEvent("r", []byte(fmt.Sprintf("%dx%d", cols, rows)))
+}
+
+func (r *sessionRecorder) recordEvent(kind string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.format {
+	case RecordFormatAsciicast:
+		event := []interface{}{time.Since(r.start).Seconds(), kind, string(data)}
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(r.file, "%s\n", encoded)
+	default:
+		if kind == "o" {
+			r.file.Write(data)
+		}
+	}
+}
+
+func (r *sessionRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.format == RecordFormatTypescript {
+		fmt.Fprintf(r.file, "\nScript done on %s\n", time.Now().Format(time.ANSIC))
+	}
+	return r.file.Close()
+}
+
+// watchTerminalResize records a resize event each time the terminal is
+// resized, until stop is closed. It is implemented per-platform in
+// rsh_resize_unix.go and rsh_resize_windows.go, since Windows has no
+// SIGWINCH-equivalent signal.
+
+// teeWriter copies every write through to the underlying writer while also
+// appending it to a sessionRecorder.
+type teeWriter struct {
+	out io.Writer
+	rec *sessionRecorder
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.out.Write(p)
+	if n > 0 {
+		t.rec.recordOutput(p[:n])
+	}
+	return n, err
+}
+
+// Close forwards to the wrapped writer when it is closeable, so that
+// wrapping a stream for recording doesn't stop closeStreams from being able
+// to unblock it on a --stream-timeout expiry.
+func (t *teeWriter) Close() error {
+	if closer, ok := t.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// teeReader copies every read through to the underlying reader while also
+// appending it to a sessionRecorder.
+type teeReader struct {
+	in  io.Reader
+	rec *sessionRecorder
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.in.Read(p)
+	if n > 0 {
+		t.rec.recordInput(p[:n])
+	}
+	return n, err
+}
+
+// Close forwards to the wrapped reader when it is closeable, so that
+// wrapping a stream for recording doesn't stop closeStreams from being able
+// to unblock it on a --stream-timeout expiry.
+func (t *teeReader) Close() error {
+	if closer, ok := t.in.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
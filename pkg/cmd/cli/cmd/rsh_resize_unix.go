@@ -0,0 +1,30 @@
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"k8s.io/kubernetes/pkg/util/term"
+)
+
+// watchTerminalResize records a resize event each time the process receives
+// SIGWINCH, until stop is closed.
+func watchTerminalResize(rec *sessionRecorder, stop <-chan struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sigCh:
+			if size, err := term.GetSize(os.Stdout.Fd()); err == nil {
+				rec.recordResize(size.Width, size.Height)
+			}
+		}
+	}
+}
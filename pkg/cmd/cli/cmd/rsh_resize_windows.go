@@ -0,0 +1,11 @@
+// +build windows
+
+package cmd
+
+// watchTerminalResize is a no-op on Windows: there is no SIGWINCH-equivalent
+// signal to watch for, so recorded sessions simply never contain resize
+// events on this platform. It still blocks until stop is closed so callers
+// can treat it the same as the unix implementation.
+func watchTerminalResize(rec *sessionRecorder, stop <-chan struct{}) {
+	<-stop
+}
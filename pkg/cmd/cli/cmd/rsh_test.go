@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestDefaultContainerFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		pod           kapi.Pod
+		wantContainer string
+		wantNames     []string
+	}{
+		{
+			name: "annotation wins over container order",
+			pod: kapi.Pod{
+				ObjectMeta: kapi.ObjectMeta{
+					Annotations: map[string]string{defaultContainerAnnotation: "sidecar"},
+				},
+				Spec: kapi.PodSpec{
+					Containers: []kapi.Container{{Name: "main"}, {Name: "sidecar"}},
+				},
+			},
+			wantContainer: "sidecar",
+			wantNames:     nil,
+		},
+		{
+			name: "no annotation falls back to first container, reports all names",
+			pod: kapi.Pod{
+				Spec: kapi.PodSpec{
+					Containers: []kapi.Container{{Name: "main"}, {Name: "sidecar"}},
+				},
+			},
+			wantContainer: "main",
+			wantNames:     []string{"main", "sidecar"},
+		},
+		{
+			name: "no annotation, single container",
+			pod: kapi.Pod{
+				Spec: kapi.PodSpec{
+					Containers: []kapi.Container{{Name: "main"}},
+				},
+			},
+			wantContainer: "main",
+			wantNames:     []string{"main"},
+		},
+		{
+			name:          "no containers at all",
+			pod:           kapi.Pod{},
+			wantContainer: "",
+			wantNames:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container, names := defaultContainerFor(&tt.pod)
+			if container != tt.wantContainer {
+				t.Errorf("container = %q, want %q", container, tt.wantContainer)
+			}
+			if len(names) != len(tt.wantNames) {
+				t.Fatalf("names = %v, want %v", names, tt.wantNames)
+			}
+			for i := range names {
+				if names[i] != tt.wantNames[i] {
+					t.Errorf("names[%d] = %q, want %q", i, names[i], tt.wantNames[i])
+				}
+			}
+		})
+	}
+}
+
+type fakeExitError struct {
+	code int
+}
+
+func (e *fakeExitError) Error() string   { return "exit error" }
+func (e *fakeExitError) ExitStatus() int { return e.code }
+
+func TestExitCodeFromError(t *testing.T) {
+	if code := exitCodeFromError(nil); code != 0 {
+		t.Errorf("nil error: got %d, want 0", code)
+	}
+	if code := exitCodeFromError(&fakeExitError{code: 42}); code != 42 {
+		t.Errorf("exitStatuser error: got %d, want 42", code)
+	}
+	if code := exitCodeFromError(errors.New("boom")); code != 1 {
+		t.Errorf("plain error: got %d, want 1", code)
+	}
+}
+
+func TestPrefixWriterBuffersCompleteLines(t *testing.T) {
+	var buf bytes.Buffer
+	sink := newPrefixWriterSink(&buf)
+	w := newPrefixWriter(sink, "[pod/container]")
+
+	if _, err := w.Write([]byte("hello\nwor")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := w.Write([]byte("ld\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	want := "[pod/container] hello\n[pod/container] world\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestPrefixWriterCloseFlushesTrailingPartialLine(t *testing.T) {
+	var buf bytes.Buffer
+	sink := newPrefixWriterSink(&buf)
+	w := newPrefixWriter(sink, "[pod/container]")
+
+	if _, err := w.Write([]byte("complete\nno newline at end")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if buf.String() != "[pod/container] complete\n" {
+		t.Fatalf("unexpected output before Close: %q", buf.String())
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := "[pod/container] complete\n[pod/container] no newline at end"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	// Closing again with nothing buffered must not write a duplicate line.
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("second Close changed output: got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSessionRecorderRawFormat(t *testing.T) {
+	path := tempRecordingPath(t)
+	defer os.Remove(path)
+
+	rec, err := newSessionRecorder(path, RecordFormatRaw)
+	if err != nil {
+		t.Fatalf("newSessionRecorder: %v", err)
+	}
+	rec.recordOutput([]byte("hello\n"))
+	rec.recordInput([]byte("ignored"))
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got := readFile(t, path)
+	if got != "hello\n" {
+		t.Errorf("raw recording = %q, want %q", got, "hello\n")
+	}
+}
+
+func TestSessionRecorderTypescriptFormat(t *testing.T) {
+	path := tempRecordingPath(t)
+	defer os.Remove(path)
+
+	rec, err := newSessionRecorder(path, RecordFormatTypescript)
+	if err != nil {
+		t.Fatalf("newSessionRecorder: %v", err)
+	}
+	rec.recordOutput([]byte("hello\n"))
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got := readFile(t, path)
+	if !strings.HasPrefix(got, "Script started on ") {
+		t.Errorf("typescript recording missing start banner: %q", got)
+	}
+	if !strings.Contains(got, "hello\n") {
+		t.Errorf("typescript recording missing output: %q", got)
+	}
+	if !strings.Contains(got, "Script done on ") {
+		t.Errorf("typescript recording missing done banner: %q", got)
+	}
+}
+
+func TestSessionRecorderAsciicastFormat(t *testing.T) {
+	path := tempRecordingPath(t)
+	defer os.Remove(path)
+
+	rec, err := newSessionRecorder(path, RecordFormatAsciicast)
+	if err != nil {
+		t.Fatalf("newSessionRecorder: %v", err)
+	}
+	rec.recordOutput([]byte("hello"))
+	rec.recordInput([]byte("i"))
+	rec.recordResize(80, 24)
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(readFile(t, path), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4 (header + o + i + r): %q", len(lines), lines)
+	}
+
+	var header map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("header not valid JSON: %v", err)
+	}
+	if header["version"].(float64) != 2 {
+		t.Errorf("header version = %v, want 2", header["version"])
+	}
+
+	wantKinds := []string{"o", "i", "r"}
+	for i, kind := range wantKinds {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &event); err != nil {
+			t.Fatalf("event %d not valid JSON: %v", i, err)
+		}
+		if len(event) != 3 {
+			t.Fatalf("event %d has %d fields, want 3", i, len(event))
+		}
+		if event[1].(string) != kind {
+			t.Errorf("event %d kind = %v, want %q", i, event[1], kind)
+		}
+	}
+}
+
+func tempRecordingPath(t *testing.T) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "rsh-record-*.cast")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	return path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return string(data)
+}